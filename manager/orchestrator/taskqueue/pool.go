@@ -0,0 +1,88 @@
+// Package taskqueue provides a small bounded worker pool for running one
+// function per task, with per-task cancellation. It exists so that a single
+// stuck task doesn't permanently tie up a slot the way blocking directly on
+// a fixed set of goroutines does, and so that callers can cancel an
+// individual in-flight task without tearing down the whole pool.
+package taskqueue
+
+import (
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// WorkerPool runs functions submitted through Add with bounded concurrency,
+// tracking a context.CancelFunc per task so any one of them can be cancelled
+// independently with Cancel. It's used by the orchestrator's Updater to run
+// task replacements, and is meant to be reusable by a future parallel-stop
+// path in the orchestrator's shutdown code.
+type WorkerPool struct {
+	ctx context.Context
+	sem chan struct{}
+	wg  sync.WaitGroup
+
+	mu      sync.Mutex
+	cancels map[string]context.CancelFunc
+}
+
+// NewWorkerPool creates a WorkerPool that runs at most parallelism functions
+// submitted through Add concurrently, each derived from ctx.
+func NewWorkerPool(ctx context.Context, parallelism int) *WorkerPool {
+	if parallelism <= 0 {
+		parallelism = 1
+	}
+	return &WorkerPool{
+		ctx:     ctx,
+		sem:     make(chan struct{}, parallelism),
+		cancels: make(map[string]context.CancelFunc),
+	}
+}
+
+// Add submits fn to run under taskID, blocking until a worker slot is
+// available. If the pool's context is done before a slot frees up, Add
+// returns without running fn. fn receives a context that's cancelled if Cancel(taskID) is
+// called or the pool's own context is done. Add itself never blocks on fn's
+// completion, and doesn't log fn's returned error - the caller already has
+// the specific context (timeout, update failure, ...) to log it meaningfully.
+func (p *WorkerPool) Add(taskID string, fn func(ctx context.Context) error) {
+	select {
+	case p.sem <- struct{}{}:
+	case <-p.ctx.Done():
+		return
+	}
+
+	taskCtx, cancel := context.WithCancel(p.ctx)
+	p.mu.Lock()
+	p.cancels[taskID] = cancel
+	p.mu.Unlock()
+
+	p.wg.Add(1)
+	go func() {
+		defer func() {
+			p.mu.Lock()
+			delete(p.cancels, taskID)
+			p.mu.Unlock()
+			cancel()
+			<-p.sem
+			p.wg.Done()
+		}()
+
+		fn(taskCtx)
+	}()
+}
+
+// Cancel cancels the context passed to the function running under taskID, if
+// one is currently in flight. It's a no-op if taskID isn't running.
+func (p *WorkerPool) Cancel(taskID string) {
+	p.mu.Lock()
+	cancel, ok := p.cancels[taskID]
+	p.mu.Unlock()
+	if ok {
+		cancel()
+	}
+}
+
+// Wait blocks until every function submitted through Add has returned.
+func (p *WorkerPool) Wait() {
+	p.wg.Wait()
+}
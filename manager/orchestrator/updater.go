@@ -1,35 +1,102 @@
 package orchestrator
 
 import (
+	"hash/fnv"
 	"reflect"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/docker/go-events"
 	"golang.org/x/net/context"
 
 	"github.com/docker/swarm-v2/api"
 	"github.com/docker/swarm-v2/log"
+	"github.com/docker/swarm-v2/manager/orchestrator/taskqueue"
 	"github.com/docker/swarm-v2/manager/state"
 	"github.com/docker/swarm-v2/manager/state/store"
 	"github.com/docker/swarm-v2/manager/state/watch"
+	"github.com/docker/swarm-v2/protobuf/ptypes"
 )
 
+// defaultMonitor is how long a replaced task is watched for failure when
+// service.Spec.Update.Monitor isn't set.
+const defaultMonitor = 30 * time.Second
+
+// UpdateEventType identifies what happened in an UpdateEvent.
+type UpdateEventType int
+
+const (
+	// EventTaskStarted is published when a slot's replacement task is created.
+	EventTaskStarted UpdateEventType = iota
+	// EventTaskReady is published once a slot's replacement task is running (and healthy, if applicable).
+	EventTaskReady
+	// EventTaskFailed is published when a slot's replacement task fails to come up or later fails.
+	EventTaskFailed
+	// EventUpdatePaused is published when a FailureAction breach pauses or rolls back the update.
+	EventUpdatePaused
+	// EventUpdateCompleted is published once every slot has been processed and
+	// the update was neither paused nor cancelled; slots whose replacement
+	// failed are included.
+	EventUpdateCompleted
+	// EventUpdateCancelled is published when the update is cancelled before completing.
+	EventUpdateCancelled
+)
+
+// UpdateEvent reports progress of a service update. It's published on
+// UpdateSupervisor's watchQueue so that Subscribe (and, through it, the
+// ControlServer.WatchServiceUpdate streaming RPC) can render live progress
+// for commands like `swarmctl service update --detach=false`.
+type UpdateEvent struct {
+	ServiceID string
+	Type      UpdateEventType
+	// TaskID is set for EventTaskStarted, EventTaskReady and EventTaskFailed.
+	TaskID string
+	// Completed and Total count slots, not tasks.
+	Completed int
+	Total     int
+	Message   string
+}
+
 // UpdateSupervisor supervises a set of updates. It's responsible for keeping track of updates,
 // shutting them down and replacing them.
 type UpdateSupervisor struct {
-	store   *store.MemoryStore
-	updates map[string]*Updater
-	l       sync.Mutex
+	store      *store.MemoryStore
+	watchQueue *watch.Queue
+	updates    map[string]*Updater
+	l          sync.Mutex
 }
 
 // NewUpdateSupervisor creates a new UpdateSupervisor.
 func NewUpdateSupervisor(store *store.MemoryStore) *UpdateSupervisor {
 	return &UpdateSupervisor{
-		store:   store,
-		updates: make(map[string]*Updater),
+		store:      store,
+		watchQueue: watch.NewQueue(0),
+		updates:    make(map[string]*Updater),
 	}
 }
 
+// Subscribe returns a channel of UpdateEvents for serviceID, and a cancel
+// function that must be called to release it once the caller is done. Events
+// for other services are filtered out before reaching the channel.
+func (u *UpdateSupervisor) Subscribe(serviceID string) (<-chan UpdateEvent, func()) {
+	ch, cancel := u.watchQueue.Watch()
+
+	out := make(chan UpdateEvent)
+	go func() {
+		defer close(out)
+		for e := range ch {
+			evt, ok := e.(UpdateEvent)
+			if !ok || evt.ServiceID != serviceID {
+				continue
+			}
+			out <- evt
+		}
+	}()
+
+	return out, cancel
+}
+
 // Update starts an Update of `tasks` belonging to `service` in the background and returns immediately.
 // If an update for that service was already in progress, it will be cancelled before the new one starts.
 func (u *UpdateSupervisor) Update(ctx context.Context, service *api.Service, tasks []*api.Task) {
@@ -42,7 +109,7 @@ func (u *UpdateSupervisor) Update(ctx context.Context, service *api.Service, tas
 		update.Cancel()
 	}
 
-	update := NewUpdater(u.store)
+	update := NewUpdater(u.store, u.Rollback, u.watchQueue)
 	u.updates[id] = update
 	go func() {
 		update.Run(ctx, service, tasks)
@@ -64,50 +131,171 @@ func (u *UpdateSupervisor) CancelAll() {
 	}
 }
 
+// Rollback is invoked by an Updater whose FailureAction is ROLLBACK once its
+// failure threshold has been breached, and backs `swarmctl service rollback`.
+// It swaps Spec and PreviousSpec (populated by the controlapi on every
+// UpdateService call) in a single transaction and launches a normal Updater
+// run against the reverted spec.
+func (u *UpdateSupervisor) Rollback(ctx context.Context, serviceID string) {
+	var (
+		service *api.Service
+		tasks   []*api.Task
+	)
+
+	err := u.store.Update(func(tx store.Tx) error {
+		s := store.GetService(tx, serviceID)
+		if s == nil {
+			return nil
+		}
+		if s.PreviousSpec == nil {
+			log.G(ctx).WithField("service.id", serviceID).Warn("no previous spec available, cannot roll back")
+			return nil
+		}
+		if s.Spec.Rollback {
+			// Refuse to chase our own tail: a spec produced by a rollback
+			// doesn't get auto-rolled-back again.
+			log.G(ctx).WithField("service.id", serviceID).Warn("refusing to roll back a spec that was itself produced by a rollback")
+			return nil
+		}
+
+		// Snapshot the current spec by value before overwriting s.Spec: taking
+		// &s.Spec after the overwrite would just point PreviousSpec at the
+		// spec we're about to replace it with.
+		old := s.Spec
+		s.Spec = *s.PreviousSpec
+		s.Spec.Rollback = true
+		s.PreviousSpec = &old
+
+		if err := store.UpdateService(tx, s); err != nil {
+			return err
+		}
+
+		var err error
+		tasks, err = store.FindTasks(tx, store.ByServiceID(serviceID))
+		if err != nil {
+			return err
+		}
+		service = s
+		return nil
+	})
+	if err != nil {
+		log.G(ctx).WithError(err).WithField("service.id", serviceID).Error("failed to roll back service")
+		return
+	}
+	if service == nil {
+		return
+	}
+
+	// Update cancels any in-flight Updater for this service before starting
+	// the rollback run.
+	u.Update(ctx, service, tasks)
+}
+
+// updateSlot groups the task(s) occupying a single slot (or, for
+// ServiceModeFill, a single node) that need attention during an update.
+// original is the task updateTask will replace; stale holds any extra
+// duplicate tasks already in the slot that should simply be marked dead
+// alongside it.
+type updateSlot struct {
+	original *api.Task
+	stale    []*api.Task
+}
+
 // Updater updates a set of tasks to a new version.
 type Updater struct {
 	store      *store.MemoryStore
 	watchQueue *watch.Queue
 
+	// events, if set, receives UpdateEvents as the update progresses. It's
+	// normally the UpdateSupervisor's own watchQueue.
+	events *watch.Queue
+	// serviceID is set at the start of Run and read by Cancel to publish a
+	// terminal event; safe without synchronization since the doneChan close
+	// that Cancel waits on happens-after the write.
+	serviceID string
+
+	// rollback is invoked when FailureAction is ROLLBACK and the failure
+	// threshold has been breached. Normally UpdateSupervisor.Rollback.
+	rollback func(ctx context.Context, serviceID string)
+
+	// totalTasks, completedTasks and failedTasks track progress and the
+	// failure ratio across the whole update, counted in slots.
+	totalTasks     uint32
+	completedTasks uint32
+	failedTasks    uint32
+
+	// pauseOnce guards against pausing the update more than once.
+	pauseOnce sync.Once
+	// rollbackOnce guards against dispatching more than one rollback if
+	// multiple slots breach MaxFailureRatio concurrently.
+	rollbackOnce sync.Once
+	// terminalOnce guards the run's single terminal event: whichever of
+	// Run's own completion, pause/rollback, or Cancel gets there first wins,
+	// so Cancel never publishes EventUpdateCancelled after the run already
+	// published its own terminal outcome.
+	terminalOnce sync.Once
+	// pausedChan is closed the first time the update needs to stop picking
+	// up new tasks, because of a FailureAction breach.
+	pausedChan chan struct{}
+
 	// stopChan signals to the state machine to stop running.
 	stopChan chan struct{}
 	// doneChan is closed when the state machine terminates.
 	doneChan chan struct{}
 }
 
-// NewUpdater creates a new Updater.
-func NewUpdater(store *store.MemoryStore) *Updater {
+// NewUpdater creates a new Updater. rollback is invoked if the update's
+// FailureAction is ROLLBACK and its failure threshold is breached; events,
+// if non-nil, receives UpdateEvents as the update progresses.
+func NewUpdater(store *store.MemoryStore, rollback func(ctx context.Context, serviceID string), events *watch.Queue) *Updater {
 	return &Updater{
 		store:      store,
 		watchQueue: store.WatchQueue(),
+		events:     events,
+		rollback:   rollback,
+		pausedChan: make(chan struct{}),
 		stopChan:   make(chan struct{}),
 		doneChan:   make(chan struct{}),
 	}
 }
 
-// Cancel cancels the current update immediately. It blocks until the cancellation is confirmed.
+// Cancel cancels the current update immediately. It blocks until the
+// cancellation is confirmed, then publishes a terminal EventUpdateCancelled -
+// unless the run already published its own terminal event (e.g.
+// UpdateSupervisor.Update calling Cancel on an Updater that completed before
+// the map cleanup goroutine removed it), in which case that one stands.
 func (u *Updater) Cancel() {
 	close(u.stopChan)
 	<-u.doneChan
+	u.terminalOnce.Do(func() {
+		u.publish(EventUpdateCancelled, "", "update cancelled")
+	})
+}
+
+// publish emits an UpdateEvent on u.events, if set, filling in the current
+// progress counts.
+func (u *Updater) publish(t UpdateEventType, taskID, message string) {
+	if u.events == nil {
+		return
+	}
+	u.events.Publish(UpdateEvent{
+		ServiceID: u.serviceID,
+		Type:      t,
+		TaskID:    taskID,
+		Completed: int(atomic.LoadUint32(&u.completedTasks)),
+		Total:     int(atomic.LoadUint32(&u.totalTasks)),
+		Message:   message,
+	})
 }
 
 // Run starts the update and returns only once its complete or cancelled.
 func (u *Updater) Run(ctx context.Context, service *api.Service, tasks []*api.Task) {
 	defer close(u.doneChan)
+	u.serviceID = service.ID
 
-	dirtyTasks := []*api.Task{}
-	for _, t := range tasks {
-		if service.Spec.GetContainer() == nil &&
-			reflect.DeepEqual(t.GetContainer().Spec, api.ContainerSpec{}) {
-			continue
-		}
-
-		if !reflect.DeepEqual(service.Spec.GetContainer(), &(t.GetContainer().Spec)) {
-			dirtyTasks = append(dirtyTasks, t)
-		}
-	}
-	// Abort immediately if all tasks are clean.
-	if len(dirtyTasks) == 0 {
+	dirtySlots := u.dirtySlots(ctx, service, tasks)
+	// Abort immediately if every slot is already up to date.
+	if len(dirtySlots) == 0 {
 		return
 	}
 
@@ -118,56 +306,343 @@ func (u *Updater) Run(ctx context.Context, service *api.Service, tasks []*api.Ta
 	if parallelism == 0 {
 		// TODO(aluzzardi): We could try to optimize unlimited parallelism by performing updates in a single
 		// goroutine using a batch transaction.
-		parallelism = len(dirtyTasks)
+		parallelism = len(dirtySlots)
 	}
 
-	// Start the workers.
-	taskQueue := make(chan *api.Task)
-	wg := sync.WaitGroup{}
-	wg.Add(parallelism)
-	for i := 0; i < parallelism; i++ {
-		go func() {
-			u.worker(ctx, service, taskQueue)
-			wg.Done()
-		}()
-	}
+	// Parallelism is counted in slots-in-flight, not tasks-in-flight: a slot
+	// with duplicate stale tasks still only occupies one worker.
+	atomic.StoreUint32(&u.totalTasks, uint32(len(dirtySlots)))
+	u.updateServiceStatus(ctx, service, api.UpdateStatus_UPDATING, "update in progress")
 
-	for _, t := range dirtyTasks {
-		// Wait for a worker to pick up the task or abort the update, whichever comes first.
+	// runCtx is done as soon as the update is cancelled or paused, so that a
+	// pool.Add blocked waiting for a worker slot doesn't outlive either.
+	runCtx, cancelRun := context.WithCancel(ctx)
+	defer cancelRun()
+	go func() {
 		select {
 		case <-u.stopChan:
-			break
+		case <-u.pausedChan:
+		case <-runCtx.Done():
+		}
+		cancelRun()
+	}()
+
+	pool := taskqueue.NewWorkerPool(runCtx, parallelism)
+	for _, slot := range dirtySlots {
+		slot := slot
+		pool.Add(slot.original.ID, func(taskCtx context.Context) error {
+			return u.runSlot(taskCtx, service, slot, pool)
+		})
+	}
+	pool.Wait()
+
+	select {
+	case <-u.pausedChan:
+		// A FailureAction breach already recorded a terminal status and event.
+	case <-u.stopChan:
+		// Cancel is responsible for the terminal event in this case.
+	default:
+		u.terminalOnce.Do(func() {
+			u.updateServiceStatus(ctx, service, api.UpdateStatus_COMPLETED, "update completed")
+			u.publish(EventUpdateCompleted, "", "update completed")
+		})
+	}
+}
+
+// dirtySlots groups tasks by slot and returns, for every slot that isn't
+// already converged on service's current spec, the updateSlot describing
+// what needs to happen to it. A slot with a task that already matches the
+// spec is left alone apart from closing out any stale duplicates in it.
+func (u *Updater) dirtySlots(ctx context.Context, service *api.Service, tasks []*api.Task) []updateSlot {
+	slots := make(map[uint64][]*api.Task)
+	for _, t := range tasks {
+		slots[slotKey(service, t)] = append(slots[slotKey(service, t)], t)
+	}
 
-		case taskQueue <- t:
+	var dirtySlots []updateSlot
+	for _, slotTasks := range slots {
+		var (
+			clean *api.Task
+			dirty []*api.Task
+		)
+		for _, t := range slotTasks {
+			if clean == nil && !u.isTaskDirty(service, t) {
+				clean = t
+			} else {
+				dirty = append(dirty, t)
+			}
+		}
+
+		if clean != nil {
+			// The slot already runs the current spec; just close out any
+			// leftover duplicates in the same raft transaction.
+			if len(dirty) > 0 {
+				if err := closeStaleTasks(u.store, dirty); err != nil {
+					log.G(ctx).WithError(err).Error("failed to close duplicate tasks")
+				}
+			}
+			continue
+		}
+		if len(dirty) == 0 {
+			continue
 		}
+
+		dirtySlots = append(dirtySlots, updateSlot{original: dirty[0], stale: dirty[1:]})
 	}
+	return dirtySlots
+}
 
-	close(taskQueue)
-	wg.Wait()
+// isTaskDirty returns true if t needs to be replaced to converge on service's
+// current spec.
+func (u *Updater) isTaskDirty(service *api.Service, t *api.Task) bool {
+	// A task with no container runtime is compared as an empty container spec.
+	var taskSpec api.ContainerSpec
+	if c := t.GetContainer(); c != nil {
+		taskSpec = c.Spec
+	}
+	if service.Spec.GetContainer() == nil &&
+		reflect.DeepEqual(taskSpec, api.ContainerSpec{}) {
+		return false
+	}
+	return !reflect.DeepEqual(service.Spec.GetContainer(), &taskSpec)
 }
 
-func (u *Updater) worker(ctx context.Context, service *api.Service, queue <-chan *api.Task) {
-	for t := range queue {
-		updated := newTask(service, t.Instance)
-		if service.Spec.Mode == api.ServiceModeFill {
-			updated.NodeID = t.NodeID
+// slotKey returns the map key dirtySlots groups tasks under. Replicated
+// services key on the task's instance number; ServiceModeFill tasks aren't
+// slotted, so they're grouped by node instead.
+func slotKey(service *api.Service, t *api.Task) uint64 {
+	if service.Spec.Mode == api.ServiceModeFill {
+		h := fnv.New64a()
+		h.Write([]byte(t.NodeID))
+		return h.Sum64()
+	}
+	return t.Instance
+}
+
+// closeStaleTasks marks every task in stale as dead, batching the mutations
+// through store.Batch so they collapse into as few raft transactions as
+// possible.
+func closeStaleTasks(s *store.MemoryStore, stale []*api.Task) error {
+	return s.Batch(func(batch *store.Batch) error {
+		for _, t := range stale {
+			t := t
+			if err := batch.Update(func(tx store.Tx) error {
+				dead := store.GetTask(tx, t.ID)
+				if dead == nil {
+					return nil
+				}
+				dead.DesiredState = api.TaskStateDead
+				return store.UpdateTask(tx, dead)
+			}); err != nil {
+				return err
+			}
 		}
+		return nil
+	})
+}
+
+// runSlot replaces a single slot, tearing the replacement down and counting
+// a failure if it doesn't come up within service.Spec.Update.TaskTimeout
+// (resolving the historic "consider adding a timeout here" TODO).
+func (u *Updater) runSlot(ctx context.Context, service *api.Service, slot updateSlot, pool *taskqueue.WorkerPool) error {
+	t := slot.original
+	updated := newTask(service, t.Instance)
+	if service.Spec.Mode == api.ServiceModeFill {
+		updated.NodeID = t.NodeID
+	}
+
+	u.publish(EventTaskStarted, updated.ID, "")
 
-		if err := u.updateTask(ctx, t, updated); err != nil {
-			log.G(ctx).WithError(err).WithField("task.id", t.ID).Error("update failed")
+	var taskTimeout time.Duration
+	if service.Spec.Update != nil {
+		taskTimeout = service.Spec.Update.TaskTimeout
+	}
+
+	// taskTimeout only bounds waiting for the replacement to become
+	// running (and healthy); updateTask applies it to that wait alone, not
+	// to anything that happens after cutover, so a slow-to-shut-down old
+	// task can't retroactively fail an already-healthy replacement.
+	err := u.updateTask(ctx, service, t, updated, slot.stale, taskTimeout)
+	if err == context.DeadlineExceeded {
+		log.G(ctx).WithField("task.id", updated.ID).Warn("task did not become running before its deadline, tearing it down")
+		// The deadline already unblocked updateTask's wait; this also
+		// cancels the slot's own (longer-lived) taskCtx, i.e. ctx here. The
+		// pool only releases the slot's worker once runSlot returns.
+		pool.Cancel(t.ID)
+		if delErr := u.store.Update(func(tx store.Tx) error {
+			return store.DeleteTask(tx, updated.ID)
+		}); delErr != nil {
+			log.G(ctx).WithError(delErr).WithField("task.id", updated.ID).Error("failed to delete timed-out replacement task")
 		}
+		atomic.AddUint32(&u.completedTasks, 1)
+		u.publish(EventTaskFailed, updated.ID, "timed out before becoming running")
+		u.recordFailure(ctx, service)
+		return err
+	}
+	if err != nil {
+		log.G(ctx).WithError(err).WithField("task.id", t.ID).Error("update failed")
+		atomic.AddUint32(&u.completedTasks, 1)
+		u.publish(EventTaskFailed, updated.ID, err.Error())
+		return err
+	}
 
-		if service.Spec.Update != nil && service.Spec.Update.Delay != 0 {
-			select {
-			case <-time.After(service.Spec.Update.Delay):
-			case <-u.stopChan:
+	atomic.AddUint32(&u.completedTasks, 1)
+	u.publish(EventTaskReady, updated.ID, "")
+
+	u.monitorTask(ctx, service, updated)
+
+	if service.Spec.Update != nil && service.Spec.Update.Delay != 0 {
+		select {
+		case <-time.After(service.Spec.Update.Delay):
+		case <-ctx.Done():
+		}
+	}
+	return nil
+}
+
+// monitorTask watches a just-replaced task for service.Spec.Update.Monitor
+// (defaultMonitor if unset) and records a failure if it transitions to
+// TaskStateFailed or TaskStateRejected during that window.
+func (u *Updater) monitorTask(ctx context.Context, service *api.Service, t *api.Task) {
+	monitor := defaultMonitor
+	if service.Spec.Update != nil && service.Spec.Update.Monitor != 0 {
+		monitor = service.Spec.Update.Monitor
+	}
+
+	taskUpdates, cancel := state.Watch(u.watchQueue, state.EventUpdateTask{
+		Task:   &api.Task{ID: t.ID},
+		Checks: []state.TaskCheckFunc{state.TaskCheckID},
+	})
+	defer cancel()
+
+	timer := time.NewTimer(monitor)
+	defer timer.Stop()
+
+	for {
+		select {
+		case e := <-taskUpdates:
+			t = e.(state.EventUpdateTask).Task
+			if t.Status.State == api.TaskStateFailed || t.Status.State == api.TaskStateRejected {
+				u.publish(EventTaskFailed, t.ID, "task failed during monitor window")
+				u.recordFailure(ctx, service)
+				return
+			}
+		case <-timer.C:
+			return
+		case <-u.stopChan:
+			return
+		}
+	}
+}
+
+// recordFailure accounts for a task failure and, once the service's
+// MaxFailureRatio is breached, applies its FailureAction.
+func (u *Updater) recordFailure(ctx context.Context, service *api.Service) {
+	failed := atomic.AddUint32(&u.failedTasks, 1)
+	total := atomic.LoadUint32(&u.totalTasks)
+	if total == 0 {
+		return
+	}
+
+	var maxRatio float32
+	if service.Spec.Update != nil {
+		maxRatio = service.Spec.Update.MaxFailureRatio
+	}
+	if float32(failed)/float32(total) <= maxRatio {
+		return
+	}
+
+	action := api.UpdateConfig_PAUSE
+	if service.Spec.Update != nil {
+		action = service.Spec.Update.FailureAction
+	}
+
+	logger := log.G(ctx).WithField("service.id", service.ID)
+	switch action {
+	case api.UpdateConfig_CONTINUE:
+		logger.Warn("update failure ratio exceeded, continuing (FailureAction=CONTINUE)")
+	case api.UpdateConfig_ROLLBACK:
+		logger.Warn("update failure ratio exceeded, rolling back")
+		u.pause(ctx, service, api.UpdateStatus_ROLLBACK_STARTED, "rolling back after exceeding failure ratio")
+		u.rollbackOnce.Do(func() {
+			if u.rollback == nil {
 				return
 			}
+			// u.rollback ultimately calls back into UpdateSupervisor.Update,
+			// which will find this very Updater still registered and call
+			// Cancel() on it. Cancel() blocks on u.doneChan, which only
+			// closes once Run's pool.Wait() returns - and pool.Wait() can't
+			// return while this call is still executing inside one of the
+			// pool's own worker goroutines (recordFailure is invoked from
+			// runSlot/monitorTask). Dispatching from a goroutine of our own
+			// lets this worker return normally, so Run can finish and
+			// Cancel() can actually observe it instead of deadlocking
+			// against itself - and holding UpdateSupervisor.l forever along
+			// with it.
+			go u.rollback(ctx, service.ID)
+		})
+	default:
+		logger.Warn("update failure ratio exceeded, pausing")
+		u.pause(ctx, service, api.UpdateStatus_PAUSED, "update paused after exceeding failure ratio")
+	}
+}
+
+// pause stops the update from picking up further tasks and records why.
+func (u *Updater) pause(ctx context.Context, service *api.Service, state api.UpdateStatus_UpdateState, message string) {
+	u.pauseOnce.Do(func() {
+		close(u.pausedChan)
+	})
+	u.terminalOnce.Do(func() {
+		u.updateServiceStatus(ctx, service, state, message)
+		u.publish(EventUpdatePaused, "", message)
+	})
+}
+
+// updateServiceStatus writes the update's current state to service.UpdateStatus
+// so that it's observable (e.g. via swarmctl service inspect).
+func (u *Updater) updateServiceStatus(ctx context.Context, service *api.Service, state api.UpdateStatus_UpdateState, message string) {
+	err := u.store.Update(func(tx store.Tx) error {
+		s := store.GetService(tx, service.ID)
+		if s == nil {
+			return nil
+		}
+		if s.UpdateStatus == nil {
+			s.UpdateStatus = &api.UpdateStatus{}
 		}
+		s.UpdateStatus.State = state
+		s.UpdateStatus.Message = message
+		now := ptypes.MustTimestampProto(time.Now())
+		switch state {
+		case api.UpdateStatus_UPDATING:
+			s.UpdateStatus.StartedAt = now
+		case api.UpdateStatus_COMPLETED, api.UpdateStatus_PAUSED, api.UpdateStatus_ROLLBACK_STARTED:
+			s.UpdateStatus.CompletedAt = now
+		}
+		return store.UpdateService(tx, s)
+	})
+	if err != nil {
+		log.G(ctx).WithError(err).WithField("service.id", service.ID).Error("failed to record update status")
 	}
 }
 
-func (u *Updater) updateTask(ctx context.Context, original, updated *api.Task) error {
+// updateTask replaces original with updated, following the order requested
+// by service.Spec.Update.Order (STOP_FIRST is the zero value and default).
+// stale, if non-empty, holds duplicate tasks in the same slot that get
+// closed out alongside the cutover so the whole slot converges in as few
+// raft transactions as possible. timeout, if non-zero, bounds only the wait
+// for updated to become running (and healthy); it never applies to anything
+// that happens after cutover.
+func (u *Updater) updateTask(ctx context.Context, service *api.Service, original, updated *api.Task, stale []*api.Task, timeout time.Duration) error {
+	if service.Spec.Update != nil && service.Spec.Update.Order == api.UpdateConfig_START_FIRST {
+		return u.startFirst(ctx, original, updated, stale, timeout)
+	}
+	return u.stopFirst(ctx, original, updated, stale, timeout)
+}
+
+// stopFirst is the default update order: the old task is marked dead in the
+// same transaction that creates its replacement, so there's a brief capacity
+// dip while the replacement starts up.
+func (u *Updater) stopFirst(ctx context.Context, original, updated *api.Task, stale []*api.Task, timeout time.Duration) error {
 	log.G(ctx).Debugf("replacing %s with %s", original.ID, updated.ID)
 	// Kick off the watch before even creating the updated task. This is in order to avoid missing any event.
 	taskUpdates, cancel := state.Watch(u.watchQueue, state.EventUpdateTask{
@@ -176,34 +651,185 @@ func (u *Updater) updateTask(ctx context.Context, original, updated *api.Task) e
 	})
 	defer cancel()
 
-	// Atomically create the updated task and bring down the old one.
-	err := u.store.Update(func(tx store.Tx) error {
-		t := store.GetTask(tx, original.ID)
-		t.DesiredState = api.TaskStateDead
-		if err := store.UpdateTask(tx, t); err != nil {
-			return err
+	// Batch bringing down the old task (and any stale duplicates) with
+	// creating the replacement so the whole slot collapses into one raft
+	// transaction.
+	err := u.store.Batch(func(batch *store.Batch) error {
+		for _, s := range stale {
+			s := s
+			if err := batch.Update(func(tx store.Tx) error {
+				dead := store.GetTask(tx, s.ID)
+				if dead == nil {
+					return nil
+				}
+				dead.DesiredState = api.TaskStateDead
+				return store.UpdateTask(tx, dead)
+			}); err != nil {
+				return err
+			}
+		}
+
+		return batch.Update(func(tx store.Tx) error {
+			t := store.GetTask(tx, original.ID)
+			t.DesiredState = api.TaskStateDead
+			if err := store.UpdateTask(tx, t); err != nil {
+				return err
+			}
+			return store.CreateTask(tx, updated)
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	waitCtx := ctx
+	if timeout != 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return u.waitForRunning(waitCtx, taskUpdates, updated)
+}
+
+// startFirst implements the START_FIRST (blue/green) update order: updated
+// is created on its own and given a chance to become healthy before original
+// is torn down, so the two tasks briefly coexist in the same slot (or, for
+// ServiceModeFill, on the same node) instead of the service dipping capacity.
+func (u *Updater) startFirst(ctx context.Context, original, updated *api.Task, stale []*api.Task, timeout time.Duration) error {
+	log.G(ctx).Debugf("starting %s before stopping %s", updated.ID, original.ID)
+
+	updatedUpdates, cancelUpdated := state.Watch(u.watchQueue, state.EventUpdateTask{
+		Task:   &api.Task{ID: updated.ID},
+		Checks: []state.TaskCheckFunc{state.TaskCheckID},
+	})
+	defer cancelUpdated()
+
+	// Stale duplicates aren't part of the cutover itself, so they can be
+	// closed out as soon as the replacement is created, batched into the
+	// same raft transaction where possible.
+	err := u.store.Batch(func(batch *store.Batch) error {
+		for _, s := range stale {
+			s := s
+			if err := batch.Update(func(tx store.Tx) error {
+				dead := store.GetTask(tx, s.ID)
+				if dead == nil {
+					return nil
+				}
+				dead.DesiredState = api.TaskStateDead
+				return store.UpdateTask(tx, dead)
+			}); err != nil {
+				return err
+			}
 		}
+		return batch.Update(func(tx store.Tx) error {
+			return store.CreateTask(tx, updated)
+		})
+	})
+	if err != nil {
+		return err
+	}
 
-		if err := store.CreateTask(tx, updated); err != nil {
+	// healthCtx bounds only this wait for updated to become running (and
+	// healthy, if applicable); it must not leak into the post-cutover wait
+	// below, or a slow-to-shut-down original would wrongly fail an already
+	// healthy replacement once healthCtx's deadline passes.
+	healthCtx := ctx
+	if timeout != 0 {
+		var cancel context.CancelFunc
+		healthCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	if err := u.waitForRunning(healthCtx, updatedUpdates, updated); err != nil {
+		if err == context.DeadlineExceeded {
+			// Let runSlot's own DeadlineExceeded branch own cleanup: it
+			// already deletes updated and records the failure.
 			return err
 		}
-		return nil
+		// ctx was cancelled for some reason other than our own deadline
+		// (e.g. a FailureAction pause elsewhere cancelling runCtx). Clean up
+		// the half-started replacement directly instead of falling through
+		// to the select below, which waitForRunning's nil-on-stopChan
+		// return is the only path that actually reaches.
+		return u.abortStartFirst(updated)
+	}
+
+	select {
+	case <-u.stopChan:
+		return u.abortStartFirst(updated)
+	case <-ctx.Done():
+		return u.abortStartFirst(updated)
+	default:
+	}
+
+	// updated is confirmed running (and healthy, if applicable): it's now
+	// safe to bring original down in a follow-up transaction.
+	originalUpdates, cancelOriginal := state.Watch(u.watchQueue, state.EventUpdateTask{
+		Task:   &api.Task{ID: original.ID},
+		Checks: []state.TaskCheckFunc{state.TaskCheckID},
+	})
+	defer cancelOriginal()
+
+	err = u.store.Update(func(tx store.Tx) error {
+		t := store.GetTask(tx, original.ID)
+		t.DesiredState = api.TaskStateDead
+		return store.UpdateTask(tx, t)
 	})
 	if err != nil {
 		return err
 	}
 
-	// Wait for the task to come up.
-	// TODO(aluzzardi): Consider adding a timeout here.
+	// Wait for original to actually start shutting down before returning, so
+	// that Update.Delay (applied by the caller once updateTask returns) only
+	// starts counting once the old task is confirmed on its way out.
 	for {
 		select {
-		case e := <-taskUpdates:
-			updated = e.(state.EventUpdateTask).Task
-			if updated.Status.State >= api.TaskStateRunning {
+		case e := <-originalUpdates:
+			if e.(state.EventUpdateTask).Task.Status.State >= api.TaskStateShutdown {
 				return nil
 			}
 		case <-u.stopChan:
 			return nil
+		case <-ctx.Done():
+			return ctx.Err()
 		}
 	}
+}
+
+// abortStartFirst tears down a replacement created by startFirst when the
+// cutover to it never happens, so the slot doesn't end up running two tasks.
+func (u *Updater) abortStartFirst(updated *api.Task) error {
+	return u.store.Update(func(tx store.Tx) error {
+		return store.DeleteTask(tx, updated.ID)
+	})
+}
+
+// waitForRunning blocks until t is reported as running (and, if a health
+// check is configured on its container spec, healthy), or the update is
+// cancelled or ctx's deadline (service.Spec.Update.TaskTimeout) expires.
+func (u *Updater) waitForRunning(ctx context.Context, updates <-chan events.Event, t *api.Task) error {
+	for {
+		select {
+		case e := <-updates:
+			t = e.(state.EventUpdateTask).Task
+			if t.Status.State >= api.TaskStateRunning && taskHealthy(t) {
+				return nil
+			}
+		case <-u.stopChan:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// taskHealthy reports whether t's container has passed the health check
+// declared on its spec, if any. Tasks without a health check are considered
+// healthy as soon as they reach TaskStateRunning; tasks with one aren't
+// considered healthy until the agent reports a passing health status for
+// them, which may be after they're already Running.
+func taskHealthy(t *api.Task) bool {
+	if t.Spec.GetContainer().GetHealthCheck() == nil {
+		return true
+	}
+	return t.Status.Healthy
 }
\ No newline at end of file
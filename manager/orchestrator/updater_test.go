@@ -0,0 +1,152 @@
+package orchestrator
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/docker/swarm-v2/api"
+	"github.com/docker/swarm-v2/manager/state/store"
+)
+
+func TestSlotKeyReplicatedUsesInstance(t *testing.T) {
+	service := &api.Service{ID: "service1"}
+
+	t1 := &api.Task{ID: "task1", ServiceID: "service1", Instance: 1}
+	t2 := &api.Task{ID: "task2", ServiceID: "service1", Instance: 2}
+	t3 := &api.Task{ID: "task3", ServiceID: "service1", Instance: 1}
+
+	if slotKey(service, t1) != slotKey(service, t3) {
+		t.Error("tasks sharing an instance number should share a slot key")
+	}
+	if slotKey(service, t1) == slotKey(service, t2) {
+		t.Error("tasks with different instance numbers should not share a slot key")
+	}
+}
+
+func TestSlotKeyServiceModeFillGroupsByNode(t *testing.T) {
+	service := &api.Service{
+		ID:   "service1",
+		Spec: api.ServiceSpec{Mode: api.ServiceModeFill},
+	}
+
+	t1 := &api.Task{ID: "task1", ServiceID: "service1", NodeID: "node-a"}
+	t2 := &api.Task{ID: "task2", ServiceID: "service1", NodeID: "node-a"}
+	t3 := &api.Task{ID: "task3", ServiceID: "service1", NodeID: "node-b"}
+
+	if slotKey(service, t1) != slotKey(service, t2) {
+		t.Error("ServiceModeFill tasks on the same node should share a slot key")
+	}
+	if slotKey(service, t1) == slotKey(service, t3) {
+		t.Error("ServiceModeFill tasks on different nodes should not share a slot key")
+	}
+}
+
+// containerSpec returns a ServiceSpec whose container spec is non-nil, which
+// makes isTaskDirty treat every task without a matching reported container
+// spec of its own (i.e. every freshly-constructed test task below) as dirty.
+func containerSpec(image string) api.ServiceSpec {
+	return api.ServiceSpec{
+		Task: api.TaskSpec{
+			Runtime: &api.TaskSpec_Container{
+				Container: &api.ContainerSpec{Image: image},
+			},
+		},
+	}
+}
+
+func TestDirtySlotsGroupsDuplicateTasksIntoOneSlot(t *testing.T) {
+	service := &api.Service{ID: "service1", Spec: containerSpec("v2")}
+
+	original := &api.Task{ID: "task1", ServiceID: "service1", Instance: 1}
+	duplicate := &api.Task{ID: "task2", ServiceID: "service1", Instance: 1}
+
+	u := &Updater{}
+	slots := u.dirtySlots(context.Background(), service, []*api.Task{original, duplicate})
+
+	if len(slots) != 1 {
+		t.Fatalf("expected 1 dirty slot, got %d", len(slots))
+	}
+	if slots[0].original.ID != original.ID {
+		t.Errorf("expected original to be %s, got %s", original.ID, slots[0].original.ID)
+	}
+	if len(slots[0].stale) != 1 || slots[0].stale[0].ID != duplicate.ID {
+		t.Errorf("expected duplicate to be carried as stale, got %+v", slots[0].stale)
+	}
+}
+
+func TestDirtySlotsGroupsServiceModeFillByNode(t *testing.T) {
+	service := &api.Service{
+		ID:   "service1",
+		Spec: containerSpec("v2"),
+	}
+	service.Spec.Mode = api.ServiceModeFill
+
+	nodeATask := &api.Task{ID: "task1", ServiceID: "service1", NodeID: "node-a"}
+	nodeADuplicate := &api.Task{ID: "task2", ServiceID: "service1", NodeID: "node-a"}
+	nodeBTask := &api.Task{ID: "task3", ServiceID: "service1", NodeID: "node-b"}
+
+	u := &Updater{}
+	slots := u.dirtySlots(context.Background(), service, []*api.Task{nodeATask, nodeADuplicate, nodeBTask})
+
+	if len(slots) != 2 {
+		t.Fatalf("expected 2 dirty slots (one per node), got %d", len(slots))
+	}
+
+	var nodeASlot, nodeBSlot *updateSlot
+	for i, s := range slots {
+		switch s.original.NodeID {
+		case "node-a":
+			nodeASlot = &slots[i]
+		case "node-b":
+			nodeBSlot = &slots[i]
+		}
+	}
+	if nodeASlot == nil || len(nodeASlot.stale) != 1 {
+		t.Errorf("expected node-a's duplicate to be carried as stale, got %+v", nodeASlot)
+	}
+	if nodeBSlot == nil || len(nodeBSlot.stale) != 0 {
+		t.Errorf("expected node-b's lone task to have no stale duplicates, got %+v", nodeBSlot)
+	}
+}
+
+func TestDirtySlotsLeavesCleanSlotAloneAndClosesStaleDuplicate(t *testing.T) {
+	s := store.NewMemoryStore(nil)
+
+	// An empty service container spec plus a task with no reported
+	// container spec of its own is exactly the "already converged" case
+	// isTaskDirty special-cases, so clean and duplicate both start out
+	// clean; dirtySlots must still single out one and close the other.
+	service := &api.Service{ID: "service1"}
+	clean := &api.Task{ID: "task1", ServiceID: "service1", Instance: 1}
+	duplicate := &api.Task{ID: "task2", ServiceID: "service1", Instance: 1}
+
+	err := s.Update(func(tx store.Tx) error {
+		if err := store.CreateTask(tx, clean); err != nil {
+			return err
+		}
+		return store.CreateTask(tx, duplicate)
+	})
+	if err != nil {
+		t.Fatalf("failed to seed store: %v", err)
+	}
+
+	u := &Updater{store: s}
+	slots := u.dirtySlots(context.Background(), service, []*api.Task{clean, duplicate})
+
+	if len(slots) != 0 {
+		t.Fatalf("expected a converged slot to produce no updateSlot, got %+v", slots)
+	}
+
+	var dup *api.Task
+	err = s.View(func(tx store.ReadTx) error {
+		dup = store.GetTask(tx, duplicate.ID)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to read back duplicate task: %v", err)
+	}
+	if dup.DesiredState != api.TaskStateDead {
+		t.Errorf("expected duplicate task to be closed out as dead, got %v", dup.DesiredState)
+	}
+}